@@ -0,0 +1,53 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sm
+
+import (
+	"github.com/cgrates/go-diameter/diam"
+)
+
+// Application is implemented by pluggable Diameter applications that
+// can be plugged into a StateMachine with RegisterApplication, such as
+// the 3GPP SWx AAA server in sm/apps/swx.
+type Application interface {
+	// Code returns the application's Auth-Application-Id (or
+	// Acct-Application-Id, for accounting-only applications).
+	Code() uint32
+
+	// VendorID returns the Vendor-Id the application is advertised
+	// under in Vendor-Specific-Application-Id. Zero means the
+	// application has no vendor and is advertised as a flat
+	// Auth-Application-Id instead.
+	VendorID() uint32
+
+	// Commands returns the command indexes the application wants
+	// routed to its ServeDIAM.
+	Commands() []diam.CommandIndex
+
+	// ServeDIAM handles a single command belonging to this
+	// application.
+	ServeDIAM(c diam.Conn, m *diam.Message)
+}
+
+// RegisterApplication adds app to the set of applications advertised
+// in this StateMachine's CER/CEA (reusing the same flat/vendor-specific
+// advertisement as SupportedApps) and installs its handlers, gated by
+// the CER/CEA handshake like every other sm handler. A peer whose CER
+// does not advertise any registered application's Auth/Acct/Vendor-
+// Specific-Application-Id is rejected with DIAMETER_NO_COMMON_APPLICATION,
+// same as for the statically configured Settings.SupportedApps.
+func (sm *StateMachine) RegisterApplication(app Application) {
+	sm.appsMu.Lock()
+	sm.supportedApps = append(sm.supportedApps, &SupportedApp{
+		ID:      app.Code(),
+		AppType: "auth",
+		Vendor:  app.VendorID(),
+	})
+	sm.appsMu.Unlock()
+
+	for _, cmd := range app.Commands() {
+		sm.mux.HandleIdx(cmd, sm.handshakeOK(app.ServeDIAM))
+	}
+}
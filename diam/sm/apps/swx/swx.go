@@ -0,0 +1,232 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package swx implements a 3GPP TS 29.273 SWx AAA server as an
+// sm.Application: Multimedia-Auth-Request/Answer for EAP-AKA
+// authentication and Server-Assignment-Request/Answer for 3GPP AAA
+// Server assignment, plus Registration-Termination and Push-Profile
+// requests the AAA server initiates towards its peer. Authentication
+// vectors and subscriber profiles are delegated to a Backend, so
+// operators can plug in GSUP, an HSS interface, or a mock for tests.
+package swx
+
+import (
+	"github.com/cgrates/go-diameter/diam"
+	"github.com/cgrates/go-diameter/diam/avp"
+	"github.com/cgrates/go-diameter/diam/datatype"
+)
+
+// AppID is the SWx Auth-Application-Id, advertised under VendorID in
+// Vendor-Specific-Application-Id per 3GPP TS 29.273 clause 8.2.
+const (
+	AppID    uint32 = 16777265
+	VendorID uint32 = 10415
+)
+
+// Command codes reused from the 3GPP Cx/Dx interface, per TS 29.273
+// clause 8.1 Table 8.1.
+var (
+	marIdx = diam.CommandIndex{AppID: AppID, Code: 303, Request: true}
+	saIdx  = diam.CommandIndex{AppID: AppID, Code: 301, Request: true}
+	rtaIdx = diam.CommandIndex{AppID: AppID, Code: 304, Request: false}
+	ppaIdx = diam.CommandIndex{AppID: AppID, Code: 305, Request: false}
+)
+
+// AuthVector is one EAP-AKA authentication vector returned by
+// Backend.Authenticate and carried in a SIP-Auth-Data-Item.
+type AuthVector struct {
+	Authenticate       []byte // SIP-Authenticate (RAND || AUTN)
+	Authorization      []byte // SIP-Authorization (expected RES)
+	ConfidentialityKey []byte
+	IntegrityKey       []byte
+}
+
+// UserProfile is the subscription data returned by
+// Backend.AssignServer and carried back in a SAA.
+type UserProfile struct {
+	ServerName       datatype.DiameterIdentity
+	SubscriptionData []byte
+}
+
+// Backend resolves SWx authentication and server-assignment requests
+// against the real subscriber store (HSS, GSUP gateway, mock, ...).
+type Backend interface {
+	// Authenticate returns up to numVectors fresh EAP-AKA vectors for
+	// imsi, for the given RAT-Type.
+	Authenticate(imsi string, numVectors int, ratType datatype.Enumerated) ([]AuthVector, error)
+
+	// AssignServer records serverName as imsi's serving 3GPP AAA
+	// Server/Proxy for the given Server-Assignment-Type and returns
+	// its subscription data.
+	AssignServer(imsi string, serverName string, saType datatype.Enumerated) (UserProfile, error)
+}
+
+// App is a 3GPP SWx AAA server, usable as an sm.Application via
+// sm.StateMachine.RegisterApplication.
+type App struct {
+	Backend Backend
+}
+
+// New returns an App backed by b.
+func New(b Backend) *App {
+	return &App{Backend: b}
+}
+
+// Code implements sm.Application.
+func (a *App) Code() uint32 { return AppID }
+
+// VendorID implements sm.Application.
+func (a *App) VendorID() uint32 { return VendorID }
+
+// Commands implements sm.Application.
+func (a *App) Commands() []diam.CommandIndex {
+	return []diam.CommandIndex{marIdx, saIdx, rtaIdx, ppaIdx}
+}
+
+// ServeDIAM implements sm.Application.
+func (a *App) ServeDIAM(c diam.Conn, m *diam.Message) {
+	switch m.Header.CommandCode {
+	case 303:
+		a.handleMAR(c, m)
+	case 301:
+		a.handleSAR(c, m)
+	default:
+		// RTA/PPA answers to requests we sent: nothing further to do.
+	}
+}
+
+// handleMAR answers a Multimedia-Auth-Request with one or more
+// SIP-Auth-Data-Item AVPs carrying EAP-AKA vectors, per TS 29.273
+// clause 8.1.2.1.
+func (a *App) handleMAR(c diam.Conn, m *diam.Message) {
+	sessionID, err := m.FindAVP(avp.SessionID, 0)
+	if err != nil {
+		answerError(c, m, diam.MissingAVP)
+		return
+	}
+	imsiAVP, err := m.FindAVP(avp.UserName, 0)
+	if err != nil {
+		answerError(c, m, diam.MissingAVP)
+		return
+	}
+	imsi, _ := imsiAVP.Data.(datatype.UTF8String)
+
+	numItems := datatype.Unsigned32(1)
+	if n, err := m.FindAVP(avp.SIPNumberAuthItems, 0); err == nil {
+		if v, ok := n.Data.(datatype.Unsigned32); ok {
+			numItems = v
+		}
+	}
+	var ratType datatype.Enumerated
+	if r, err := m.FindAVP(avp.RATType, 0); err == nil {
+		if v, ok := r.Data.(datatype.Enumerated); ok {
+			ratType = v
+		}
+	}
+
+	vectors, err := a.Backend.Authenticate(string(imsi), int(numItems), ratType)
+	if err != nil {
+		answerError(c, m, diam.UnableToComply)
+		return
+	}
+
+	ans := m.Answer(diam.Success)
+	ans.NewAVP(avp.SessionID, avp.Mbit, 0, sessionID.Data)
+	ans.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(1)) // NO_STATE_MAINTAINED
+	ans.NewAVP(avp.UserName, avp.Mbit, 0, imsi)
+	ans.NewAVP(avp.SIPNumberAuthItems, avp.Mbit, 0, datatype.Unsigned32(len(vectors)))
+	for i, v := range vectors {
+		ans.NewAVP(avp.SIPAuthDataItem, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.SIPItemNumber, avp.Mbit, 0, datatype.Unsigned32(i)),
+				diam.NewAVP(avp.SIPAuthenticationScheme, avp.Mbit, 0, datatype.UTF8String("EAP-AKA")),
+				diam.NewAVP(avp.SIPAuthenticate, avp.Mbit, 0, datatype.OctetString(v.Authenticate)),
+				diam.NewAVP(avp.SIPAuthorization, avp.Mbit, 0, datatype.OctetString(v.Authorization)),
+				diam.NewAVP(avp.ConfidentialityKey, avp.Mbit, 0, datatype.OctetString(v.ConfidentialityKey)),
+				diam.NewAVP(avp.IntegrityKey, avp.Mbit, 0, datatype.OctetString(v.IntegrityKey)),
+			},
+		})
+	}
+	ans.WriteTo(c)
+}
+
+// handleSAR answers a Server-Assignment-Request by recording the
+// requesting server as imsi's serving 3GPP AAA Server/Proxy, per TS
+// 29.273 clause 8.1.2.2.
+func (a *App) handleSAR(c diam.Conn, m *diam.Message) {
+	sessionID, err := m.FindAVP(avp.SessionID, 0)
+	if err != nil {
+		answerError(c, m, diam.MissingAVP)
+		return
+	}
+	imsiAVP, err := m.FindAVP(avp.UserName, 0)
+	if err != nil {
+		answerError(c, m, diam.MissingAVP)
+		return
+	}
+	imsi, _ := imsiAVP.Data.(datatype.UTF8String)
+
+	hostAVP, _ := m.FindAVP(avp.OriginHost, 0)
+	var serverName datatype.DiameterIdentity
+	if hostAVP != nil {
+		serverName, _ = hostAVP.Data.(datatype.DiameterIdentity)
+	}
+
+	var saType datatype.Enumerated
+	if s, err := m.FindAVP(avp.ServerAssignmentType, 0); err == nil {
+		if v, ok := s.Data.(datatype.Enumerated); ok {
+			saType = v
+		}
+	}
+
+	profile, err := a.Backend.AssignServer(string(imsi), string(serverName), saType)
+	if err != nil {
+		answerError(c, m, diam.UnableToComply)
+		return
+	}
+
+	ans := m.Answer(diam.Success)
+	ans.NewAVP(avp.SessionID, avp.Mbit, 0, sessionID.Data)
+	ans.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(1))
+	ans.NewAVP(avp.UserName, avp.Mbit, 0, imsi)
+	if len(profile.SubscriptionData) > 0 {
+		ans.NewAVP(avp.NonThreeGPPUserData, avp.Mbit, 0, datatype.OctetString(profile.SubscriptionData))
+	}
+	ans.WriteTo(c)
+}
+
+// SendRTR sends a Registration-Termination-Request to c, asking the
+// peer (a 3GPP AAA proxy or ePDG) to deregister imsi, per TS 29.273
+// clause 8.1.2.3. The RTA is delivered back through ServeDIAM.
+func (a *App) SendRTR(c diam.Conn, originHost, originRealm datatype.DiameterIdentity, imsi string, reason datatype.Enumerated) error {
+	m := diam.NewRequest(304, AppID, nil)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, originHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, originRealm)
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String(imsi))
+	m.NewAVP(avp.DeregistrationReason, avp.Mbit, 0, &diam.GroupedAVP{
+		AVP: []*diam.AVP{
+			diam.NewAVP(avp.ReasonCode, avp.Mbit, 0, reason),
+		},
+	})
+	_, err := m.WriteTo(c)
+	return err
+}
+
+// SendPPR pushes updated subscription data for imsi to c via a
+// Push-Profile-Request, per TS 29.273 clause 8.1.2.4. The PPA is
+// delivered back through ServeDIAM.
+func (a *App) SendPPR(c diam.Conn, originHost, originRealm datatype.DiameterIdentity, imsi string, subscriptionData []byte) error {
+	m := diam.NewRequest(305, AppID, nil)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, originHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, originRealm)
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String(imsi))
+	m.NewAVP(avp.NonThreeGPPUserData, avp.Mbit, 0, datatype.OctetString(subscriptionData))
+	_, err := m.WriteTo(c)
+	return err
+}
+
+func answerError(c diam.Conn, m *diam.Message, resultCode uint32) {
+	a := m.Answer(resultCode)
+	a.WriteTo(c)
+}
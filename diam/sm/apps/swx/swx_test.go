@@ -0,0 +1,173 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package swx
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cgrates/go-diameter/diam"
+	"github.com/cgrates/go-diameter/diam/avp"
+	"github.com/cgrates/go-diameter/diam/datatype"
+	"github.com/cgrates/go-diameter/diam/dict"
+)
+
+// fakeConn is a minimal diam.Conn that buffers whatever is written to
+// it, so ServeDIAM can be driven end-to-end without a real transport.
+type fakeConn struct {
+	buf bytes.Buffer
+	ctx context.Context
+	nc  net.Conn
+}
+
+func newFakeConn() *fakeConn {
+	nc, _ := net.Pipe()
+	return &fakeConn{nc: nc}
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+func (c *fakeConn) Close()                      {}
+func (c *fakeConn) LocalAddr() net.Addr         { return c.nc.LocalAddr() }
+func (c *fakeConn) RemoteAddr() net.Addr        { return c.nc.RemoteAddr() }
+func (c *fakeConn) TLS() *tls.ConnectionState   { return nil }
+func (c *fakeConn) Dictionary() *dict.Parser    { return dict.Default }
+func (c *fakeConn) Connection() net.Conn        { return c.nc }
+func (c *fakeConn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+func (c *fakeConn) SetContext(ctx context.Context) { c.ctx = ctx }
+
+type mockBackend struct {
+	vectors []AuthVector
+	authErr error
+
+	profile   UserProfile
+	assignErr error
+	gotIMSI   string
+	gotServer string
+}
+
+func (b *mockBackend) Authenticate(imsi string, numVectors int, ratType datatype.Enumerated) ([]AuthVector, error) {
+	if b.authErr != nil {
+		return nil, b.authErr
+	}
+	return b.vectors, nil
+}
+
+func (b *mockBackend) AssignServer(imsi, serverName string, saType datatype.Enumerated) (UserProfile, error) {
+	b.gotIMSI = imsi
+	b.gotServer = serverName
+	if b.assignErr != nil {
+		return UserProfile{}, b.assignErr
+	}
+	return b.profile, nil
+}
+
+func TestAppIdentity(t *testing.T) {
+	b := &mockBackend{}
+	a := New(b)
+	if a.Code() != AppID {
+		t.Errorf("expected Code() %d, got %d", AppID, a.Code())
+	}
+	if a.VendorID() != VendorID {
+		t.Errorf("expected VendorID() %d, got %d", VendorID, a.VendorID())
+	}
+	cmds := a.Commands()
+	if len(cmds) != 4 {
+		t.Fatalf("expected 4 commands, got %d: %v", len(cmds), cmds)
+	}
+	for _, idx := range cmds {
+		if idx.AppID != AppID {
+			t.Errorf("command %v has unexpected AppID", idx)
+		}
+	}
+}
+
+func TestBackendAuthenticateError(t *testing.T) {
+	b := &mockBackend{authErr: errors.New("hss unreachable")}
+	_, err := b.Authenticate("001010000000001", 1, datatype.Enumerated(0))
+	if err == nil {
+		t.Fatal("expected error from Authenticate")
+	}
+}
+
+func TestBackendAssignServerRecordsServerName(t *testing.T) {
+	b := &mockBackend{profile: UserProfile{ServerName: "aaa.example.com"}}
+	profile, err := b.AssignServer("001010000000001", "aaa.example.com", datatype.Enumerated(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.gotIMSI != "001010000000001" || b.gotServer != "aaa.example.com" {
+		t.Errorf("unexpected recorded call: imsi=%q server=%q", b.gotIMSI, b.gotServer)
+	}
+	if profile.ServerName != "aaa.example.com" {
+		t.Errorf("unexpected profile server name %q", profile.ServerName)
+	}
+}
+
+func TestServeDIAMRoutesByCommandCode(t *testing.T) {
+	// ServeDIAM must not panic on an unrecognized command (e.g. an
+	// RTA/PPA answer, which this App only ever sends and does not
+	// need to act further on).
+	a := New(&mockBackend{})
+	m := diam.NewRequest(304, AppID, nil)
+	m.Header.CommandFlags &^= 0x80 // mark as an answer
+	a.ServeDIAM(nil, m)
+}
+
+func TestHandleMARMissingSessionID(t *testing.T) {
+	// A MAR with no Session-Id must answer MissingAVP rather than
+	// panic dereferencing a nil AVP.
+	a := New(&mockBackend{vectors: []AuthVector{{}}})
+	m := diam.NewRequest(303, AppID, nil)
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String("001010000000001"))
+	c := newFakeConn()
+	a.ServeDIAM(c, m)
+}
+
+func TestHandleSARMissingSessionID(t *testing.T) {
+	// Same as above, for Server-Assignment-Request.
+	a := New(&mockBackend{})
+	m := diam.NewRequest(301, AppID, nil)
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String("001010000000001"))
+	c := newFakeConn()
+	a.ServeDIAM(c, m)
+}
+
+func TestHandleMARAnswersWithVectors(t *testing.T) {
+	b := &mockBackend{vectors: []AuthVector{{Authenticate: []byte("rand||autn")}}}
+	a := New(b)
+	m := diam.NewRequest(303, AppID, nil)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("session;1"))
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String("001010000000001"))
+	c := newFakeConn()
+	a.ServeDIAM(c, m)
+	if c.buf.Len() == 0 {
+		t.Fatal("expected MAA to be written to the connection")
+	}
+}
+
+func TestHandleSARAnswersWithProfile(t *testing.T) {
+	b := &mockBackend{profile: UserProfile{ServerName: "aaa.example.com"}}
+	a := New(b)
+	m := diam.NewRequest(301, AppID, nil)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("session;1"))
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String("001010000000001"))
+	c := newFakeConn()
+	a.ServeDIAM(c, m)
+	if c.buf.Len() == 0 {
+		t.Fatal("expected SAA to be written to the connection")
+	}
+	if b.gotIMSI != "001010000000001" {
+		t.Errorf("unexpected recorded IMSI %q", b.gotIMSI)
+	}
+}
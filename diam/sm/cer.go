@@ -0,0 +1,336 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sm
+
+import (
+	"fmt"
+
+	"github.com/cgrates/go-diameter/diam"
+	"github.com/cgrates/go-diameter/diam/avp"
+	"github.com/cgrates/go-diameter/diam/datatype"
+	"github.com/cgrates/go-diameter/diam/sm/smpeer"
+)
+
+// RFC 6733 and 3GPP-extended Result-Code values relevant to the
+// CER/CEA handshake. Diameter base protocol result codes (e.g.
+// diam.Success) are defined in the diam package; these are specific
+// to capabilities exchange and are not generally useful elsewhere.
+const (
+	DiameterUnableToComply      uint32 = 5012
+	DiameterNoCommonApplication uint32 = 5010
+	DiameterNoCommonSecurity    uint32 = 5017
+	DiameterUnknownPeer         uint32 = 3010
+)
+
+// CapabilitiesExchangeError is returned on ErrorReports when a peer
+// rejects our CER, or we reject its CER, with a non-Success
+// Result-Code.
+type CapabilitiesExchangeError struct {
+	ResultCode uint32
+	OriginHost datatype.DiameterIdentity
+}
+
+func (e *CapabilitiesExchangeError) Error() string {
+	return fmt.Sprintf("sm: capabilities exchange with %q failed, Result-Code %d",
+		e.OriginHost, e.ResultCode)
+}
+
+// handleCER handles Capabilities-Exchange-Request messages, validates
+// the peer per RFC 6733 section 5.3, and answers with a CEA carrying
+// either Success or one of the standard CER/CEA error Result-Codes.
+func handleCER(sm *StateMachine) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		originHost, err := m.FindAVP(avp.OriginHost, 0)
+		if err != nil {
+			rejectCER(sm, c, m, DiameterUnableToComply, "", err)
+			return
+		}
+		originRealm, err := m.FindAVP(avp.OriginRealm, 0)
+		if err != nil {
+			rejectCER(sm, c, m, DiameterUnableToComply, "", err)
+			return
+		}
+		peerHost, _ := originHost.Data.(datatype.DiameterIdentity)
+		peerRealm, _ := originRealm.Data.(datatype.DiameterIdentity)
+
+		if !sm.peerAllowed(peerHost) {
+			rejectCER(sm, c, m, DiameterUnknownPeer, peerHost, nil)
+			return
+		}
+
+		peerApps, peerVendorApps := parsePeerApps(m)
+		if !sm.commonAppExists(peerApps, peerVendorApps) {
+			rejectCER(sm, c, m, DiameterNoCommonApplication, peerHost, nil)
+			return
+		}
+
+		if !negotiateInbandSecurity(m) {
+			rejectCER(sm, c, m, DiameterNoCommonSecurity, peerHost, nil)
+			return
+		}
+
+		if sm.cfg.CERValidator != nil {
+			if rc, avps := sm.cfg.CERValidator(m); rc != diam.Success {
+				rejectCERWithAVPs(sm, c, m, rc, peerHost, avps)
+				return
+			}
+		}
+
+		a := m.Answer(diam.Success)
+		sm.writeCEAApps(a)
+		a.NewAVP(avp.OriginHost, avp.Mbit, 0, sm.cfg.OriginHost)
+		a.NewAVP(avp.OriginRealm, avp.Mbit, 0, sm.cfg.OriginRealm)
+		for _, ip := range sm.cfg.HostIPAddresses {
+			a.NewAVP(avp.HostIPAddress, avp.Mbit, 0, ip)
+		}
+		a.NewAVP(avp.VendorID, avp.Mbit, 0, sm.cfg.VendorID)
+		a.NewAVP(avp.ProductName, 0, 0, sm.cfg.ProductName)
+		if sm.cfg.OriginStateID != 0 {
+			a.NewAVP(avp.OriginStateID, avp.Mbit, 0, sm.cfg.OriginStateID)
+		}
+		if sm.cfg.FirmwareRevision != 0 {
+			a.NewAVP(avp.FirmwareRevision, 0, 0, sm.cfg.FirmwareRevision)
+		}
+		if _, err := a.WriteTo(c); err != nil {
+			sm.Error(&diam.ErrorReport{Conn: c, Message: m, Error: err})
+			return
+		}
+
+		vendorID, productName := parsePeerIdentity(m)
+		meta := &smpeer.Metadata{
+			OriginHost:  peerHost,
+			OriginRealm: peerRealm,
+			VendorID:    vendorID,
+			ProductName: productName,
+			Apps:        peerApps,
+			VendorApps:  peerVendorApps,
+		}
+		c.SetContext(smpeer.NewContext(c.Context(), meta))
+		sm.handshakeDone(c, meta)
+	}
+}
+
+// handleCEA processes the answer to a CER we sent as a client. A
+// non-Success Result-Code is surfaced on ErrorReports as a
+// CapabilitiesExchangeError and the connection is closed; otherwise
+// the handshake is considered complete.
+func handleCEA(sm *StateMachine) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		rcAVP, err := m.FindAVP(avp.ResultCode, 0)
+		if err != nil {
+			sm.Error(&diam.ErrorReport{Conn: c, Message: m, Error: err})
+			c.Close()
+			return
+		}
+		rc, _ := rcAVP.Data.(datatype.Unsigned32)
+
+		originHost, _ := m.FindAVP(avp.OriginHost, 0)
+		var peerHost datatype.DiameterIdentity
+		if originHost != nil {
+			peerHost, _ = originHost.Data.(datatype.DiameterIdentity)
+		}
+
+		if uint32(rc) != diam.Success {
+			sm.Error(&diam.ErrorReport{
+				Conn:    c,
+				Message: m,
+				Error:   &CapabilitiesExchangeError{ResultCode: uint32(rc), OriginHost: peerHost},
+			})
+			sm.publish(PeerEvent{Kind: PeerReject, Conn: c, ResultCode: uint32(rc)})
+			c.Close()
+			return
+		}
+
+		peerApps, peerVendorApps := parsePeerApps(m)
+		originRealm, _ := m.FindAVP(avp.OriginRealm, 0)
+		var peerRealm datatype.DiameterIdentity
+		if originRealm != nil {
+			peerRealm, _ = originRealm.Data.(datatype.DiameterIdentity)
+		}
+		vendorID, productName := parsePeerIdentity(m)
+		meta := &smpeer.Metadata{
+			OriginHost:  peerHost,
+			OriginRealm: peerRealm,
+			VendorID:    vendorID,
+			ProductName: productName,
+			Apps:        peerApps,
+			VendorApps:  peerVendorApps,
+		}
+		c.SetContext(smpeer.NewContext(c.Context(), meta))
+		sm.handshakeDone(c, meta)
+	}
+}
+
+// peerAllowed reports whether host is allowed to connect. An unset
+// Settings.PeerAllowList means every peer is allowed, preserving the
+// pre-allowlist behavior.
+func (sm *StateMachine) peerAllowed(host datatype.DiameterIdentity) bool {
+	if len(sm.cfg.PeerAllowList) == 0 {
+		return true
+	}
+	for _, allowed := range sm.cfg.PeerAllowList {
+		if allowed == host {
+			return true
+		}
+	}
+	return false
+}
+
+// commonAppExists reports whether any of the peer's advertised apps
+// (flat or vendor-specific) intersects with sm.supportedApps.
+func (sm *StateMachine) commonAppExists(peerApps []uint32, peerVendorApps map[uint32][]uint32) bool {
+	sm.appsMu.RLock()
+	defer sm.appsMu.RUnlock()
+	for _, local := range sm.supportedApps {
+		if local.Vendor == 0 {
+			for _, id := range peerApps {
+				if id == local.ID {
+					return true
+				}
+			}
+			continue
+		}
+		for _, id := range peerVendorApps[local.Vendor] {
+			if id == local.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsePeerApps extracts the flat Auth/Acct-Application-Id values and
+// the Vendor-Specific-Application-Id grouped values from m.
+func parsePeerApps(m *diam.Message) (apps []uint32, vendorApps map[uint32][]uint32) {
+	vendorApps = make(map[uint32][]uint32)
+	for _, a := range m.AVP {
+		switch a.Code {
+		case avp.AuthApplicationID, avp.AcctApplicationID:
+			if id, ok := a.Data.(datatype.Unsigned32); ok && uint32(id) != 0 {
+				apps = append(apps, uint32(id))
+			}
+		case avp.VendorSpecificApplicationID:
+			grp, ok := a.Data.(*diam.GroupedAVP)
+			if !ok {
+				continue
+			}
+			var vendorID uint32
+			var appID uint32
+			for _, inner := range grp.AVP {
+				switch inner.Code {
+				case avp.VendorID:
+					if v, ok := inner.Data.(datatype.Unsigned32); ok {
+						vendorID = uint32(v)
+					}
+				case avp.AuthApplicationID, avp.AcctApplicationID:
+					if v, ok := inner.Data.(datatype.Unsigned32); ok {
+						appID = uint32(v)
+					}
+				}
+			}
+			if vendorID != 0 && appID != 0 {
+				vendorApps[vendorID] = append(vendorApps[vendorID], appID)
+			}
+		}
+	}
+	return apps, vendorApps
+}
+
+// parsePeerIdentity extracts the peer's top-level Vendor-Id and
+// Product-Name AVPs from its CER/CEA, both of which are optional per
+// RFC 6733 section 5.3 and left zero-valued if absent.
+func parsePeerIdentity(m *diam.Message) (vendorID datatype.Unsigned32, productName datatype.UTF8String) {
+	if a, err := m.FindAVP(avp.VendorID, 0); err == nil {
+		vendorID, _ = a.Data.(datatype.Unsigned32)
+	}
+	if a, err := m.FindAVP(avp.ProductName, 0); err == nil {
+		productName, _ = a.Data.(datatype.UTF8String)
+	}
+	return vendorID, productName
+}
+
+// negotiateInbandSecurity reports whether we can proceed given the
+// peer's Inband-Security-Id. This implementation only supports
+// NO_INBAND_SECURITY (0), which is also the default when the AVP is
+// absent, matching every peer tested in diameter_capx_SUITE that does
+// not request TLS-in-band.
+func negotiateInbandSecurity(m *diam.Message) bool {
+	a, err := m.FindAVP(avp.InbandSecurityID, 0)
+	if err != nil {
+		return true
+	}
+	id, ok := a.Data.(datatype.Unsigned32)
+	return ok && id == 0
+}
+
+// writeCEAApps appends the locally supported applications to a CEA
+// being built. Apps with no vendor are emitted as flat
+// Auth/Acct-Application-Id AVPs; apps tied to a vendor are grouped
+// into a Vendor-Specific-Application-Id AVP per RFC 6733 section
+// 5.3.3, one per app since the grouping only carries a single
+// Auth-Application-Id or Acct-Application-Id each. Every vendor with
+// at least one such app also gets a Supported-Vendor-Id AVP.
+func (sm *StateMachine) writeCEAApps(a *diam.Message) {
+	sm.appsMu.RLock()
+	defer sm.appsMu.RUnlock()
+	var vendorOrder []uint32
+	vendorApps := make(map[uint32][]*SupportedApp)
+	for _, app := range sm.supportedApps {
+		if app.Vendor == 0 {
+			if app.AppType == "acct" {
+				a.NewAVP(avp.AcctApplicationID, avp.Mbit, 0, datatype.Unsigned32(app.ID))
+			} else {
+				a.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(app.ID))
+			}
+			continue
+		}
+		if _, ok := vendorApps[app.Vendor]; !ok {
+			vendorOrder = append(vendorOrder, app.Vendor)
+		}
+		vendorApps[app.Vendor] = append(vendorApps[app.Vendor], app)
+	}
+	for _, vendor := range vendorOrder {
+		a.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, datatype.Unsigned32(vendor))
+		for _, app := range vendorApps[vendor] {
+			appCode := uint32(avp.AuthApplicationID)
+			if app.AppType == "acct" {
+				appCode = avp.AcctApplicationID
+			}
+			a.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+				AVP: []*diam.AVP{
+					diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(vendor)),
+					diam.NewAVP(appCode, avp.Mbit, 0, datatype.Unsigned32(app.ID)),
+				},
+			})
+		}
+	}
+}
+
+// rejectCER answers m with resultCode and closes the connection, as
+// required for CER errors (the peer has not yet passed the handshake
+// so nothing else may use the transport).
+func rejectCER(sm *StateMachine, c diam.Conn, m *diam.Message, resultCode uint32, peerHost datatype.DiameterIdentity, cause error) {
+	rejectCERWithAVPs(sm, c, m, resultCode, peerHost, nil)
+	if cause != nil {
+		sm.Error(&diam.ErrorReport{Conn: c, Message: m, Error: cause})
+	}
+}
+
+func rejectCERWithAVPs(sm *StateMachine, c diam.Conn, m *diam.Message, resultCode uint32, peerHost datatype.DiameterIdentity, errAVPs []*diam.AVP) {
+	a := m.Answer(resultCode)
+	a.NewAVP(avp.OriginHost, avp.Mbit, 0, sm.cfg.OriginHost)
+	a.NewAVP(avp.OriginRealm, avp.Mbit, 0, sm.cfg.OriginRealm)
+	for _, av := range errAVPs {
+		a.AVP = append(a.AVP, av)
+	}
+	a.WriteTo(c)
+	sm.Error(&diam.ErrorReport{
+		Conn:    c,
+		Message: m,
+		Error:   &CapabilitiesExchangeError{ResultCode: resultCode, OriginHost: peerHost},
+	})
+	sm.publish(PeerEvent{Kind: PeerReject, Conn: c, ResultCode: resultCode})
+	c.Close()
+}
@@ -0,0 +1,419 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sm
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cgrates/go-diameter/diam"
+	"github.com/cgrates/go-diameter/diam/avp"
+	"github.com/cgrates/go-diameter/diam/datatype"
+	"github.com/cgrates/go-diameter/diam/dict"
+)
+
+// fakeConn is a minimal diam.Conn that buffers whatever is written to
+// it and records whether Close was called, so CER/CEA handlers can be
+// driven end-to-end without a real transport.
+type fakeConn struct {
+	buf    bytes.Buffer
+	ctx    context.Context
+	closed bool
+	nc     net.Conn
+}
+
+func newFakeConn() *fakeConn {
+	nc, _ := net.Pipe()
+	return &fakeConn{nc: nc}
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+func (c *fakeConn) Close()                      { c.closed = true }
+func (c *fakeConn) LocalAddr() net.Addr         { return c.nc.LocalAddr() }
+func (c *fakeConn) RemoteAddr() net.Addr        { return c.nc.RemoteAddr() }
+func (c *fakeConn) TLS() *tls.ConnectionState   { return nil }
+func (c *fakeConn) Dictionary() *dict.Parser    { return dict.Default }
+func (c *fakeConn) Connection() net.Conn        { return c.nc }
+func (c *fakeConn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+func (c *fakeConn) SetContext(ctx context.Context) { c.ctx = ctx }
+
+// countVendorSpecificApps walks the AVPs a CEA/CER builder produced and
+// returns, per vendor, the set of Auth/Acct-Application-Id values
+// carried inside Vendor-Specific-Application-Id groups, plus the set
+// of advertised Supported-Vendor-Id values.
+func countVendorSpecificApps(t *testing.T, m *diam.Message) (vendorApps map[uint32][]uint32, supportedVendors []uint32) {
+	t.Helper()
+	vendorApps = make(map[uint32][]uint32)
+	for _, a := range m.AVP {
+		switch a.Code {
+		case avp.SupportedVendorID:
+			id, ok := a.Data.(datatype.Unsigned32)
+			if !ok {
+				t.Fatalf("Supported-Vendor-Id has unexpected Data type %T", a.Data)
+			}
+			supportedVendors = append(supportedVendors, uint32(id))
+		case avp.VendorSpecificApplicationID:
+			grp, ok := a.Data.(*diam.GroupedAVP)
+			if !ok {
+				t.Fatalf("Vendor-Specific-Application-Id has unexpected Data type %T", a.Data)
+			}
+			var vendorID, appID uint32
+			for _, inner := range grp.AVP {
+				switch inner.Code {
+				case avp.VendorID:
+					v, _ := inner.Data.(datatype.Unsigned32)
+					vendorID = uint32(v)
+				case avp.AuthApplicationID, avp.AcctApplicationID:
+					v, _ := inner.Data.(datatype.Unsigned32)
+					appID = uint32(v)
+				}
+			}
+			vendorApps[vendorID] = append(vendorApps[vendorID], appID)
+		}
+	}
+	return vendorApps, supportedVendors
+}
+
+func TestWriteCEAAppsGroupsVendorSpecificApps(t *testing.T) {
+	var testDicts = []string{
+		"../dict/testdata/base.xml",
+		"../dict/testdata/credit_control.xml",
+		"../dict/testdata/network_access_server.xml",
+		"../dict/testdata/tgpp_ro_rf.xml",
+		"../dict/testdata/tgpp_s6a.xml",
+		"../dict/testdata/tgpp_swx.xml",
+	}
+	parser, err := dict.NewParser(testDicts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &StateMachine{
+		cfg:           &Settings{},
+		supportedApps: PrepareSupportedApps(parser, nil),
+	}
+	m := diam.NewRequest(diam.CapabilitiesExchange, 0, parser)
+	sm.writeCEAApps(m)
+
+	vendorApps, supportedVendors := countVendorSpecificApps(t, m)
+
+	wantVendorApps := map[uint32][]uint32{
+		10415: {4, 16777251, 16777265},
+	}
+	for vendor, wantIDs := range wantVendorApps {
+		gotIDs := vendorApps[vendor]
+		if len(gotIDs) != len(wantIDs) {
+			t.Fatalf("vendor %d: expected %d apps, got %d (%v)", vendor, len(wantIDs), len(gotIDs), gotIDs)
+		}
+		for _, want := range wantIDs {
+			found := false
+			for _, got := range gotIDs {
+				if got == want {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("vendor %d: expected app %d in %v", vendor, want, gotIDs)
+			}
+		}
+	}
+
+	if len(supportedVendors) != 1 || supportedVendors[0] != 10415 {
+		t.Errorf("expected Supported-Vendor-Id [10415], got %v", supportedVendors)
+	}
+
+	// Charging Control (3) and NASREQ (1) have no vendor and must be
+	// advertised as flat Auth/Acct-Application-Id, not grouped.
+	var flatAcct, flatAuth int
+	for _, a := range m.AVP {
+		switch a.Code {
+		case avp.AcctApplicationID:
+			flatAcct++
+		case avp.AuthApplicationID:
+			flatAuth++
+		}
+	}
+	if flatAcct != 1 || flatAuth != 1 {
+		t.Errorf("expected 1 flat Acct-Application-Id and 1 flat Auth-Application-Id, got %d/%d", flatAcct, flatAuth)
+	}
+}
+
+func TestParsePeerAppsRoundTripsVendorSpecificApps(t *testing.T) {
+	var testDicts = []string{
+		"../dict/testdata/base.xml",
+		"../dict/testdata/tgpp_s6a.xml",
+		"../dict/testdata/tgpp_swx.xml",
+	}
+	parser, err := dict.NewParser(testDicts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &StateMachine{
+		cfg:           &Settings{},
+		supportedApps: PrepareSupportedApps(parser, []string{"TGPP.TGPP S6A", "TGPP.TGPP SWX"}),
+	}
+	m := diam.NewRequest(diam.CapabilitiesExchange, 0, parser)
+	sm.writeCEAApps(m)
+
+	apps, vendorApps := parsePeerApps(m)
+	if len(apps) != 0 {
+		t.Errorf("expected no flat apps, got %v", apps)
+	}
+	ids := vendorApps[10415]
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 vendor-10415 apps, got %v", ids)
+	}
+}
+
+// expectCapabilitiesExchangeError reads a single ErrorReport off sm
+// and asserts it wraps a *CapabilitiesExchangeError with the given
+// Result-Code. sm.Error ultimately delivers through the diam package's
+// ServeMux, whose delivery may require a concurrent reader, so f is
+// run in its own goroutine (mirroring TestStateMachineTCP).
+func expectCapabilitiesExchangeError(t *testing.T, sm *StateMachine, f func(), wantResult uint32) {
+	t.Helper()
+	go f()
+	select {
+	case err := <-sm.ErrorReports():
+		cxErr, ok := err.Error.(*CapabilitiesExchangeError)
+		if !ok {
+			t.Fatalf("expected *CapabilitiesExchangeError, got %T (%v)", err.Error, err.Error)
+		}
+		if cxErr.ResultCode != wantResult {
+			t.Errorf("expected Result-Code %d, got %d", wantResult, cxErr.ResultCode)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ErrorReport")
+	}
+}
+
+// TestHandleCERRejections mirrors the test matrix in Erlang's
+// diameter_capx_SUITE (s_no_common_application, s_unknown_peer, ...):
+// one rejection reason in, one Result-Code on ErrorReports out.
+func TestHandleCERRejections(t *testing.T) {
+	parser, err := dict.NewParser("../dict/testdata/base.xml", "../dict/testdata/tgpp_s6a.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCER := func() *diam.Message {
+		m := diam.NewRequest(diam.CapabilitiesExchange, 0, parser)
+		m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("peer.example.com"))
+		m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.com"))
+		m.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(10415)),
+				diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(16777251)), // TGPP S6a
+			},
+		})
+		return m
+	}
+
+	tests := []struct {
+		name       string // mirrors the analogous diameter_capx_SUITE case
+		settings   func(cfg *Settings)
+		message    func() *diam.Message
+		wantResult uint32
+	}{
+		{
+			name:       "s_malformed_cer",
+			message:    func() *diam.Message { return diam.NewRequest(diam.CapabilitiesExchange, 0, parser) },
+			wantResult: DiameterUnableToComply,
+		},
+		{
+			name: "s_unknown_peer",
+			settings: func(cfg *Settings) {
+				cfg.PeerAllowList = []datatype.DiameterIdentity{"other.example.com"}
+			},
+			wantResult: DiameterUnknownPeer,
+		},
+		{
+			name: "s_no_common_application",
+			message: func() *diam.Message {
+				m := diam.NewRequest(diam.CapabilitiesExchange, 0, parser)
+				m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("peer.example.com"))
+				m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.com"))
+				m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(999999))
+				return m
+			},
+			wantResult: DiameterNoCommonApplication,
+		},
+		{
+			name: "s_no_common_security",
+			message: func() *diam.Message {
+				m := newCER()
+				m.NewAVP(avp.InbandSecurityID, avp.Mbit, 0, datatype.Unsigned32(1))
+				return m
+			},
+			wantResult: DiameterNoCommonSecurity,
+		},
+		{
+			name: "s_validator_rejects",
+			settings: func(cfg *Settings) {
+				cfg.CERValidator = func(m *diam.Message) (uint32, []*diam.AVP) {
+					return DiameterUnableToComply, nil
+				}
+			},
+			wantResult: DiameterUnableToComply,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := New(&Settings{OriginHost: "server.example.com", OriginRealm: "example.com"})
+			sm.supportedApps = PrepareSupportedApps(parser, nil)
+			if tt.settings != nil {
+				tt.settings(sm.cfg)
+			}
+			m := newCER
+			if tt.message != nil {
+				m = tt.message
+			}
+			c := newFakeConn()
+			expectCapabilitiesExchangeError(t, sm, func() { handleCER(sm)(c, m()) }, tt.wantResult)
+		})
+	}
+}
+
+// TestHandleCERAccepts exercises the success path: a CER that passes
+// every check gets a Success CEA, an Up PeerEvent carrying the peer's
+// Metadata (including Vendor-Id/Product-Name), and a HandshakeNotify.
+func TestHandleCERAccepts(t *testing.T) {
+	parser, err := dict.NewParser("../dict/testdata/base.xml", "../dict/testdata/tgpp_s6a.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := New(&Settings{OriginHost: "server.example.com", OriginRealm: "example.com"})
+	sm.supportedApps = PrepareSupportedApps(parser, nil)
+	events := sm.Subscribe()
+
+	m := diam.NewRequest(diam.CapabilitiesExchange, 0, parser)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("peer.example.com"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.com"))
+	m.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+		AVP: []*diam.AVP{
+			diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(10415)),
+			diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(16777251)),
+		},
+	})
+	m.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(99))
+	m.NewAVP(avp.ProductName, 0, 0, datatype.UTF8String("peer-product"))
+
+	c := newFakeConn()
+	handleCER(sm)(c, m)
+
+	if c.buf.Len() == 0 {
+		t.Fatal("expected a CEA to be written to the connection")
+	}
+	select {
+	case ev := <-events:
+		if ev.Kind != Up {
+			t.Fatalf("expected Up event, got %v", ev.Kind)
+		}
+		if ev.Metadata.OriginHost != "peer.example.com" {
+			t.Errorf("unexpected Metadata.OriginHost %q", ev.Metadata.OriginHost)
+		}
+		if ev.Metadata.VendorID != 99 {
+			t.Errorf("expected Metadata.VendorID 99, got %d", ev.Metadata.VendorID)
+		}
+		if ev.Metadata.ProductName != "peer-product" {
+			t.Errorf("expected Metadata.ProductName %q, got %q", "peer-product", ev.Metadata.ProductName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Up event")
+	}
+	select {
+	case got := <-sm.HandshakeNotify():
+		if got != c {
+			t.Error("expected HandshakeNotify to carry the handshaking connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for HandshakeNotify")
+	}
+}
+
+// TestHandleCEARejects exercises a client receiving a non-Success
+// CEA: the Result-Code is surfaced as a CapabilitiesExchangeError and
+// a PeerReject event is published.
+func TestHandleCEARejects(t *testing.T) {
+	sm := New(&Settings{OriginHost: "client.example.com", OriginRealm: "example.com"})
+	events := sm.Subscribe()
+
+	m := diam.NewRequest(diam.CapabilitiesExchange, 0, dict.Default)
+	m.Header.CommandFlags &^= 0x80 // mark as an answer
+	m.NewAVP(avp.ResultCode, avp.Mbit, 0, datatype.Unsigned32(DiameterNoCommonApplication))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("peer.example.com"))
+
+	c := newFakeConn()
+	expectCapabilitiesExchangeError(t, sm, func() { handleCEA(sm)(c, m) }, DiameterNoCommonApplication)
+
+	select {
+	case ev := <-events:
+		if ev.Kind != PeerReject {
+			t.Fatalf("expected PeerReject event, got %v", ev.Kind)
+		}
+		if ev.ResultCode != DiameterNoCommonApplication {
+			t.Errorf("expected ResultCode %d, got %d", DiameterNoCommonApplication, ev.ResultCode)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for PeerReject event")
+	}
+}
+
+// TestHandleCEAAccepts exercises a client receiving a Success CEA: the
+// handshake completes and the peer's Metadata is populated from the
+// CEA's AVPs.
+func TestHandleCEAAccepts(t *testing.T) {
+	parser, err := dict.NewParser("../dict/testdata/base.xml", "../dict/testdata/tgpp_s6a.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := New(&Settings{OriginHost: "client.example.com", OriginRealm: "example.com"})
+	events := sm.Subscribe()
+
+	m := diam.NewRequest(diam.CapabilitiesExchange, 0, parser)
+	m.Header.CommandFlags &^= 0x80 // mark as an answer
+	m.NewAVP(avp.ResultCode, avp.Mbit, 0, datatype.Unsigned32(diam.Success))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("server.example.com"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.com"))
+	m.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(10415))
+	m.NewAVP(avp.ProductName, 0, 0, datatype.UTF8String("server-product"))
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(16777251))
+
+	c := newFakeConn()
+	handleCEA(sm)(c, m)
+
+	select {
+	case ev := <-events:
+		if ev.Kind != Up {
+			t.Fatalf("expected Up event, got %v", ev.Kind)
+		}
+		if ev.Metadata.VendorID != 10415 {
+			t.Errorf("expected Metadata.VendorID 10415, got %d", ev.Metadata.VendorID)
+		}
+		if ev.Metadata.ProductName != "server-product" {
+			t.Errorf("expected Metadata.ProductName %q, got %q", "server-product", ev.Metadata.ProductName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Up event")
+	}
+	select {
+	case got := <-sm.HandshakeNotify():
+		if got != c {
+			t.Error("expected HandshakeNotify to carry the handshaking connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for HandshakeNotify")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cgrates/go-diameter/diam"
 	"github.com/cgrates/go-diameter/diam/datatype"
@@ -106,8 +108,40 @@ type Settings struct {
 	//
 	// Deprecated: HostIPAddress is depreciated, use HostIPAddresses instead
 	HostIPAddress datatype.Address
+
+	// WatchdogInterval is the RFC 3539 Tw timer: the base interval
+	// between Device-Watchdog-Request messages sent while a peer is
+	// in the OKAY state. Defaults to 30 seconds when unset.
+	WatchdogInterval time.Duration
+
+	// WatchdogJitter bounds the +/- jitter applied to every
+	// WatchdogInterval firing, as mandated by RFC 3539 section 3.4.1
+	// to avoid synchronized watchdogs across peers. Defaults to 2
+	// seconds when unset.
+	WatchdogJitter time.Duration
+
+	// PeerAllowList restricts which Origin-Host values may complete
+	// the CER/CEA handshake. A peer not on the list is rejected with
+	// DIAMETER_UNKNOWN_PEER. Leaving it empty allows every peer,
+	// preserving the historical behavior.
+	PeerAllowList []datatype.DiameterIdentity
+
+	// CERValidator lets applications apply extra acceptance rules on
+	// top of the built-in CER checks (e.g. DIAMETER_ELECTION_LOST, or
+	// rejecting a peer based on policy). Returning a Result-Code other
+	// than diam.Success rejects the CER with that code and the given
+	// AVPs attached to the CEA.
+	CERValidator func(m *diam.Message) (resultCode uint32, errAVPs []*diam.AVP)
 }
 
+// DefaultWatchdogInterval is the RFC 3539 recommended Tw value used
+// when Settings.WatchdogInterval is unset.
+const DefaultWatchdogInterval = 30 * time.Second
+
+// DefaultWatchdogJitter is the RFC 3539 recommended jitter bound used
+// when Settings.WatchdogJitter is unset.
+const DefaultWatchdogJitter = 2 * time.Second
+
 var (
 	baseCERIdx = diam.CommandIndex{AppID: 0, Code: diam.CapabilitiesExchange, Request: true}
 	baseCEAIdx = diam.CommandIndex{AppID: 0, Code: diam.CapabilitiesExchange, Request: false}
@@ -120,10 +154,18 @@ var (
 // Other handlers registered in the state machine are only executed
 // after the peer has passed the initial CER/CEA handshake.
 type StateMachine struct {
-	cfg           *Settings
-	mux           *diam.ServeMux
-	hsNotifyc     chan diam.Conn // handshake notifier
+	cfg       *Settings
+	mux       *diam.ServeMux
+	hsNotifyc chan diam.Conn // handshake notifier
+
+	appsMu        sync.RWMutex // guards supportedApps
 	supportedApps []*SupportedApp
+
+	mu        sync.Mutex // guards watchdogs
+	watchdogs map[diam.Conn]*watchdog
+
+	subMu sync.Mutex // guards subs
+	subs  []chan PeerEvent
 }
 
 // New creates and initializes a new StateMachine for clients or servers.
@@ -131,15 +173,25 @@ func New(settings *Settings) *StateMachine {
 	if len(settings.HostIPAddresses) == 0 && len(settings.HostIPAddress) > 0 {
 		settings.HostIPAddresses = []datatype.Address{settings.HostIPAddress}
 	}
+	if settings.WatchdogInterval == 0 {
+		settings.WatchdogInterval = DefaultWatchdogInterval
+	}
+	if settings.WatchdogJitter == 0 {
+		settings.WatchdogJitter = DefaultWatchdogJitter
+	}
 	sm := &StateMachine{
 		cfg:           settings,
 		mux:           diam.NewServeMux(),
 		hsNotifyc:     make(chan diam.Conn),
 		supportedApps: PrepareSupportedApps(dict.Default, settings.SupportedApps),
+		watchdogs:     make(map[diam.Conn]*watchdog),
 	}
 	sm.mux.Handle("CER", handleCER(sm))
-	sm.mux.Handle("DWR", handshakeOK(handleDWR(sm)))
+	sm.mux.Handle("CEA", handleCEA(sm))
+	sm.mux.Handle("DWR", sm.handshakeOK(handleDWR(sm)))
+	sm.mux.Handle("DWA", sm.handshakeOK(handleDWA(sm)))
 	sm.mux.HandleIdx(baseCERIdx, handleCER(sm))
+	sm.mux.HandleIdx(baseCEAIdx, handleCEA(sm))
 	sm.mux.HandleIdx(baseDWRIdx, handleDWR(sm))
 	return sm
 }
@@ -166,7 +218,7 @@ func (sm *StateMachine) HandleIdx(cmd diam.CommandIndex, handler diam.Handler) {
 			Error: fmt.Errorf("cannot overwrite %v command in the state machine", cmd),
 		})
 	default:
-		sm.mux.HandleIdx(cmd, handshakeOK(handler.ServeDIAM))
+		sm.mux.HandleIdx(cmd, sm.handshakeOK(handler.ServeDIAM))
 	}
 }
 
@@ -178,7 +230,7 @@ func (sm *StateMachine) HandleFunc(cmd string, handler diam.HandlerFunc) {
 			Error: fmt.Errorf("cannot overwrite %s command in the state machine", cmd),
 		})
 	default:
-		sm.mux.Handle(cmd, handshakeOK(handler))
+		sm.mux.Handle(cmd, sm.handshakeOK(handler))
 	}
 }
 
@@ -206,14 +258,28 @@ type HandshakeNotifier interface {
 	HandshakeNotify() <-chan diam.Conn
 }
 
-// handshakeOK is a wrapper for state machine handlers that only
-// calls the designated handler function if the peer has passed the
-// CER/CEA handshake.
-type handshakeOK diam.HandlerFunc
-
-// ServeDIAM implements the diam.Handler interface.
-func (f handshakeOK) ServeDIAM(c diam.Conn, m *diam.Message) {
-	if _, ok := smpeer.FromContext(c.Context()); ok {
+// handshakeOK wraps a handler so that it only runs once the peer has
+// passed the CER/CEA handshake. Every message that reaches a wrapped
+// handler also counts as proof of life for the RFC 3539 watchdog, so
+// passing traffic (including DWA) brings a SUSPECT peer back to OKAY.
+func (sm *StateMachine) handshakeOK(f diam.HandlerFunc) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		if _, ok := smpeer.FromContext(c.Context()); !ok {
+			return
+		}
+		sm.watchdogReceived(c)
 		f(c, m)
 	}
 }
+
+// handshakeDone is called by the CER/CEA handlers once a peer has
+// successfully completed the capabilities exchange. It starts the
+// RFC 3539 watchdog for the connection, publishes an Up PeerEvent, and
+// notifies anyone waiting on HandshakeNotify.
+func (sm *StateMachine) handshakeDone(c diam.Conn, meta *smpeer.Metadata) {
+	sm.startWatchdog(c)
+	sm.publish(PeerEvent{Kind: Up, Conn: c, Metadata: meta})
+	go func() {
+		sm.hsNotifyc <- c
+	}()
+}
@@ -0,0 +1,48 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package smpeer carries the peer metadata learned from a CER/CEA
+// handshake on a diam.Conn's context, so that state machine handlers
+// can tell whether (and who) a connection has authenticated as.
+package smpeer
+
+import (
+	"context"
+
+	"github.com/cgrates/go-diameter/diam/datatype"
+)
+
+// Metadata about a peer, attached to a diam.Conn's context once it
+// has completed the CER/CEA handshake.
+type Metadata struct {
+	OriginHost  datatype.DiameterIdentity
+	OriginRealm datatype.DiameterIdentity
+	VendorID    datatype.Unsigned32
+	ProductName datatype.UTF8String
+
+	// Apps are the flat (non vendor-specific) Auth/Acct-Application-Id
+	// values the peer advertised in its CER/CEA.
+	Apps []uint32
+
+	// VendorApps are the applications the peer advertised inside a
+	// Vendor-Specific-Application-Id grouped AVP, keyed by the
+	// advertised Vendor-Id.
+	VendorApps map[uint32][]uint32
+}
+
+type contextKey int
+
+const metadataKey contextKey = 0
+
+// NewContext returns a copy of ctx carrying meta, retrievable with
+// FromContext.
+func NewContext(ctx context.Context, meta *Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey, meta)
+}
+
+// FromContext returns the Metadata stored in ctx by NewContext, if any.
+func FromContext(ctx context.Context) (*Metadata, bool) {
+	meta, ok := ctx.Value(metadataKey).(*Metadata)
+	return meta, ok
+}
@@ -0,0 +1,110 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sm
+
+import (
+	"fmt"
+
+	"github.com/cgrates/go-diameter/diam"
+	"github.com/cgrates/go-diameter/diam/sm/smpeer"
+)
+
+// EventKind identifies the kind of notification carried by a PeerEvent.
+type EventKind int
+
+// Event kinds delivered through StateMachine.Subscribe.
+const (
+	// Up fires once a connection has completed the CER/CEA handshake.
+	Up EventKind = iota
+	// Down fires when the RFC 3539 watchdog transitions a peer to
+	// DOWN, or its transport is otherwise closed.
+	Down
+	// Watchdog fires on every RFC 3539 watchdog state transition,
+	// including the INITIAL -> OKAY one driven by Up.
+	Watchdog
+	// PeerReject fires when a CER/CEA is rejected, either by us or
+	// by the peer.
+	PeerReject
+)
+
+// String implements the fmt.Stringer interface.
+func (k EventKind) String() string {
+	switch k {
+	case Up:
+		return "Up"
+	case Down:
+		return "Down"
+	case Watchdog:
+		return "Watchdog"
+	case PeerReject:
+		return "PeerReject"
+	default:
+		return "Unknown"
+	}
+}
+
+// PeerEvent is a structured notification about a peer connection's
+// lifecycle, delivered through StateMachine.Subscribe. Only the
+// fields relevant to Kind are populated.
+type PeerEvent struct {
+	Kind EventKind
+	Conn diam.Conn
+
+	// Metadata is set on Up.
+	Metadata *smpeer.Metadata
+
+	// Reason is set on Down.
+	Reason error
+
+	// From and To are set on Watchdog.
+	From, To PeerState
+
+	// ResultCode is set on PeerReject.
+	ResultCode uint32
+}
+
+// subscriberBuffer bounds how many undelivered events a subscriber
+// may accumulate before the oldest one is dropped in its favor.
+const subscriberBuffer = 16
+
+// Subscribe returns a channel that receives every PeerEvent this
+// StateMachine emits: handshake completion, watchdog transitions,
+// CER/CEA rejections and peer-down notifications. Multiple
+// subscribers are supported; a slow subscriber has its oldest
+// buffered event dropped (reported via ErrorReports) rather than
+// blocking the rest of the state machine.
+func (sm *StateMachine) Subscribe() <-chan PeerEvent {
+	ch := make(chan PeerEvent, subscriberBuffer)
+	sm.subMu.Lock()
+	sm.subs = append(sm.subs, ch)
+	sm.subMu.Unlock()
+	return ch
+}
+
+// publish fans ev out to every subscriber.
+func (sm *StateMachine) publish(ev PeerEvent) {
+	sm.subMu.Lock()
+	defer sm.subMu.Unlock()
+	for _, ch := range sm.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Buffer full: drop the oldest queued event to make room
+			// rather than block the caller.
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- ev:
+			default:
+			}
+			sm.Error(&diam.ErrorReport{
+				Conn:  ev.Conn,
+				Error: fmt.Errorf("sm: subscriber buffer full, dropped oldest %s event", ev.Kind),
+			})
+		}
+	}
+}
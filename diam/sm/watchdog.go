@@ -0,0 +1,288 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sm
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cgrates/go-diameter/diam"
+	"github.com/cgrates/go-diameter/diam/avp"
+	"github.com/cgrates/go-diameter/diam/datatype"
+)
+
+// PeerState represents a connection's position in the RFC 3539 section
+// 3.4 watchdog state machine.
+type PeerState int
+
+// Watchdog states, per RFC 3539 section 3.4. REOPEN is not modeled: a
+// DOWN connection's transport is closed outright rather than kept
+// around for reconnection, so the peer's watchdog never needs to
+// represent that state.
+const (
+	StateInitial PeerState = iota
+	StateOkay
+	StateSuspect
+	StateDown
+)
+
+// String implements the fmt.Stringer interface.
+func (s PeerState) String() string {
+	switch s {
+	case StateInitial:
+		return "INITIAL"
+	case StateOkay:
+		return "OKAY"
+	case StateSuspect:
+		return "SUSPECT"
+	case StateDown:
+		return "DOWN"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// watchdog tracks the RFC 3539 DWR/DWA liveness state of a single
+// peer connection.
+type watchdog struct {
+	sm *StateMachine
+	c  diam.Conn
+
+	mu            sync.Mutex
+	state         PeerState
+	timer         *time.Timer
+	lastOriginSID datatype.Unsigned32
+	haveOriginSID bool
+	stopped       bool
+}
+
+// startWatchdog creates and starts the watchdog for c, transitioning
+// it from INITIAL to OKAY as required right after a successful CER/CEA
+// handshake.
+func (sm *StateMachine) startWatchdog(c diam.Conn) {
+	w := &watchdog{sm: sm, c: c, state: StateOkay}
+	sm.mu.Lock()
+	sm.watchdogs[c] = w
+	sm.mu.Unlock()
+	sm.onWatchdogStateChange(c, StateInitial, StateOkay)
+	w.timer = time.AfterFunc(sm.watchdogTick(), w.fire)
+}
+
+// stopWatchdog stops and discards the watchdog associated with c, if
+// any. Called when the transport is closed.
+func (sm *StateMachine) stopWatchdog(c diam.Conn) {
+	sm.mu.Lock()
+	w, ok := sm.watchdogs[c]
+	delete(sm.watchdogs, c)
+	sm.mu.Unlock()
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mu.Unlock()
+}
+
+// watchdogReceived records proof of life for c: any DWA or application
+// message received while the peer is SUSPECT brings it back to OKAY,
+// per RFC 3539 section 3.4.1.
+func (sm *StateMachine) watchdogReceived(c diam.Conn) {
+	sm.mu.Lock()
+	w, ok := sm.watchdogs[c]
+	sm.mu.Unlock()
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	from := w.state
+	if from == StateSuspect {
+		w.state = StateOkay
+	}
+	to := w.state
+	if w.timer != nil {
+		w.timer.Reset(sm.watchdogTick())
+	}
+	w.mu.Unlock()
+	if from != to {
+		sm.onWatchdogStateChange(c, from, to)
+	}
+}
+
+// PeerState returns the current RFC 3539 watchdog state of c, or
+// StateInitial if c has no watchdog (e.g. it never completed the
+// handshake).
+func (sm *StateMachine) PeerState(c diam.Conn) PeerState {
+	sm.mu.Lock()
+	w, ok := sm.watchdogs[c]
+	sm.mu.Unlock()
+	if !ok {
+		return StateInitial
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+// watchdogTick returns Tw jittered by +/- WatchdogJitter, as required
+// by RFC 3539 section 3.4.1 to keep watchdogs from synchronizing
+// across peers.
+func (sm *StateMachine) watchdogTick() time.Duration {
+	base := sm.cfg.WatchdogInterval
+	jitter := sm.cfg.WatchdogJitter
+	if jitter <= 0 {
+		return base
+	}
+	n := rand.Int63n(2*int64(jitter)+1) - int64(jitter)
+	return base + time.Duration(n)
+}
+
+// fire runs on every Tw expiration. While OKAY it sends a DWR and
+// moves to SUSPECT; a second expiration with no answer means the peer
+// is DOWN.
+func (w *watchdog) fire() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	state := w.state
+	w.mu.Unlock()
+
+	switch state {
+	case StateOkay:
+		if err := w.sendDWR(); err != nil {
+			w.down(err)
+			return
+		}
+		w.mu.Lock()
+		from := w.state
+		w.state = StateSuspect
+		w.timer.Reset(w.sm.watchdogTick())
+		w.mu.Unlock()
+		w.sm.onWatchdogStateChange(w.c, from, StateSuspect)
+	case StateSuspect:
+		w.down(errDWATimeout)
+	default:
+		// Nothing to do in DOWN/INITIAL: the watchdog is stopped.
+	}
+}
+
+// errDWATimeout is reported when a second Tw elapses with no DWA (or
+// other traffic) after a DWR was sent, per RFC 3539 section 3.4.1.
+var errDWATimeout = errDeviceWatchdogTimeout{}
+
+type errDeviceWatchdogTimeout struct{}
+
+func (errDeviceWatchdogTimeout) Error() string {
+	return "sm: no Device-Watchdog-Answer received, peer considered down"
+}
+
+// sendDWR builds and writes a Device-Watchdog-Request on w.c.
+func (w *watchdog) sendDWR() error {
+	cfg := w.sm.cfg
+	m := diam.NewRequest(diam.DeviceWatchdog, 0, nil)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+	if cfg.OriginStateID != 0 {
+		m.NewAVP(avp.OriginStateID, avp.Mbit, 0, cfg.OriginStateID)
+	}
+	_, err := m.WriteTo(w.c)
+	return err
+}
+
+// down transitions the peer to DOWN, reports the cause, stops and
+// discards its watchdog, and closes the transport. Failover of
+// in-flight requests to an alternate peer is the responsibility of
+// the application driving Subscribe/ErrorReports; the watchdog only
+// guarantees the DOWN transition fires exactly once.
+func (w *watchdog) down(cause error) {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	from := w.state
+	w.state = StateDown
+	w.mu.Unlock()
+
+	w.sm.publish(PeerEvent{Kind: Watchdog, Conn: w.c, From: from, To: StateDown})
+	w.sm.publish(PeerEvent{Kind: Down, Conn: w.c, Reason: cause})
+	w.sm.Error(&diam.ErrorReport{Conn: w.c, Error: cause})
+	w.sm.stopWatchdog(w.c)
+	w.c.Close()
+}
+
+// checkOriginStateID compares the peer's current Origin-State-Id to
+// the last value seen on this connection, per RFC 3539 section 3.4.1:
+// a changed value after a REOPEN means the peer restarted and any
+// pending requests must be treated as failed over rather than failed
+// back.
+func (w *watchdog) checkOriginStateID(m *diam.Message) (changed bool) {
+	a, err := m.FindAVP(avp.OriginStateID, 0)
+	if err != nil {
+		return false
+	}
+	sid, ok := a.Data.(datatype.Unsigned32)
+	if !ok {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	changed = w.haveOriginSID && sid != w.lastOriginSID
+	w.lastOriginSID = sid
+	w.haveOriginSID = true
+	return changed
+}
+
+// onWatchdogStateChange is the single hook every non-terminal watchdog
+// transition flows through (the DOWN transition is handled directly by
+// watchdog.down, since it also needs to carry a Reason on the Down
+// event). It publishes a Watchdog PeerEvent for Subscribe callers.
+func (sm *StateMachine) onWatchdogStateChange(c diam.Conn, from, to PeerState) {
+	sm.publish(PeerEvent{Kind: Watchdog, Conn: c, From: from, To: to})
+}
+
+// handleDWR answers Device-Watchdog-Request messages and counts them
+// as proof of life for the sender's own watchdog.
+func handleDWR(sm *StateMachine) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		sm.watchdogReceived(c)
+		a := m.Answer(diam.Success)
+		a.NewAVP(avp.OriginHost, avp.Mbit, 0, sm.cfg.OriginHost)
+		a.NewAVP(avp.OriginRealm, avp.Mbit, 0, sm.cfg.OriginRealm)
+		if sm.cfg.OriginStateID != 0 {
+			a.NewAVP(avp.OriginStateID, avp.Mbit, 0, sm.cfg.OriginStateID)
+		}
+		a.WriteTo(c)
+	}
+}
+
+// handleDWA processes the answer to a DWR we sent. Proof of life is
+// handled generically by handshakeOK/watchdogReceived for every
+// message; handleDWA additionally checks Origin-State-Id so a peer
+// that restarted mid-SUSPECT is reported rather than silently treated
+// as a clean failback.
+func handleDWA(sm *StateMachine) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		sm.mu.Lock()
+		w, ok := sm.watchdogs[c]
+		sm.mu.Unlock()
+		if !ok {
+			return
+		}
+		if w.checkOriginStateID(m) {
+			sm.Error(&diam.ErrorReport{
+				Conn:    c,
+				Message: m,
+				Error:   fmt.Errorf("sm: peer Origin-State-Id changed, failing over pending requests"),
+			})
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cgrates/go-diameter/diam"
+	"github.com/cgrates/go-diameter/diam/avp"
+	"github.com/cgrates/go-diameter/diam/datatype"
+)
+
+// watchdogTestSettings returns Settings with a short, jitter-free
+// WatchdogInterval so the OKAY/SUSPECT/DOWN timer transitions can be
+// exercised without a multi-second test.
+func watchdogTestSettings() *Settings {
+	return &Settings{
+		OriginHost:       datatype.DiameterIdentity("origin.example.com"),
+		OriginRealm:      datatype.DiameterIdentity("example.com"),
+		WatchdogInterval: 10 * time.Millisecond,
+		WatchdogJitter:   -1, // disable jitter: New() only applies DefaultWatchdogJitter when this is exactly zero
+	}
+}
+
+func waitPeerEvent(t *testing.T, sm *StateMachine, ch <-chan PeerEvent) PeerEvent {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	case err := <-sm.ErrorReports():
+		t.Fatalf("unexpected error report while waiting for PeerEvent: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for PeerEvent")
+	}
+	return PeerEvent{}
+}
+
+func TestWatchdogTickJitterBounds(t *testing.T) {
+	sm := &StateMachine{cfg: &Settings{
+		WatchdogInterval: 10 * time.Second,
+		WatchdogJitter:   2 * time.Second,
+	}}
+	for i := 0; i < 100; i++ {
+		d := sm.watchdogTick()
+		if d < 8*time.Second || d > 12*time.Second {
+			t.Fatalf("watchdogTick() = %v, want within [8s, 12s]", d)
+		}
+	}
+}
+
+func TestWatchdogTickNoJitterWhenZero(t *testing.T) {
+	sm := &StateMachine{cfg: &Settings{WatchdogInterval: 10 * time.Second}}
+	if d := sm.watchdogTick(); d != 10*time.Second {
+		t.Fatalf("watchdogTick() = %v, want exactly 10s with no jitter configured", d)
+	}
+}
+
+// TestWatchdogOkayToSuspectToDown drives a watchdog through every
+// state RFC 3539 section 3.4.1 defines for a peer that stops
+// answering: INITIAL -> OKAY on start, OKAY -> SUSPECT on the first
+// missed Tw, SUSPECT -> DOWN on the second.
+func TestWatchdogOkayToSuspectToDown(t *testing.T) {
+	sm := New(watchdogTestSettings())
+	c := newFakeConn()
+	events := sm.Subscribe()
+
+	sm.startWatchdog(c)
+	if ev := waitPeerEvent(t, sm, events); ev.Kind != Watchdog || ev.From != StateInitial || ev.To != StateOkay {
+		t.Fatalf("expected INITIAL->OKAY, got %+v", ev)
+	}
+	if got := sm.PeerState(c); got != StateOkay {
+		t.Fatalf("PeerState() = %v, want OKAY", got)
+	}
+
+	if ev := waitPeerEvent(t, sm, events); ev.Kind != Watchdog || ev.From != StateOkay || ev.To != StateSuspect {
+		t.Fatalf("expected OKAY->SUSPECT, got %+v", ev)
+	}
+	if got := sm.PeerState(c); got != StateSuspect {
+		t.Fatalf("PeerState() = %v, want SUSPECT", got)
+	}
+
+	gotDown, gotWatchdog := false, false
+	for i := 0; i < 2; i++ {
+		switch ev := waitPeerEvent(t, sm, events); ev.Kind {
+		case Down:
+			gotDown = true
+			if ev.Reason != errDWATimeout {
+				t.Errorf("Down event Reason = %v, want errDWATimeout", ev.Reason)
+			}
+		case Watchdog:
+			gotWatchdog = true
+			if ev.From != StateSuspect || ev.To != StateDown {
+				t.Errorf("expected SUSPECT->DOWN, got %+v", ev)
+			}
+		}
+	}
+	if !gotDown || !gotWatchdog {
+		t.Fatalf("expected both a Down and a Watchdog(SUSPECT->DOWN) event, got down=%v watchdog=%v", gotDown, gotWatchdog)
+	}
+	if got := sm.PeerState(c); got != StateDown {
+		t.Fatalf("PeerState() = %v, want DOWN", got)
+	}
+	select {
+	case err := <-sm.ErrorReports():
+		if err.Error != errDWATimeout {
+			t.Errorf("ErrorReport.Error = %v, want errDWATimeout", err.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the DOWN ErrorReport")
+	}
+}
+
+// TestWatchdogReceivedBringsSuspectBackToOkay covers the DWA (or any
+// other traffic) case of RFC 3539 section 3.4.1: proof of life while
+// SUSPECT returns the peer to OKAY without ever going DOWN.
+func TestWatchdogReceivedBringsSuspectBackToOkay(t *testing.T) {
+	sm := New(watchdogTestSettings())
+	c := newFakeConn()
+	events := sm.Subscribe()
+
+	sm.startWatchdog(c)
+	waitPeerEvent(t, sm, events) // INITIAL -> OKAY
+
+	if ev := waitPeerEvent(t, sm, events); ev.From != StateOkay || ev.To != StateSuspect {
+		t.Fatalf("expected OKAY->SUSPECT, got %+v", ev)
+	}
+
+	sm.watchdogReceived(c)
+	if ev := waitPeerEvent(t, sm, events); ev.Kind != Watchdog || ev.From != StateSuspect || ev.To != StateOkay {
+		t.Fatalf("expected SUSPECT->OKAY, got %+v", ev)
+	}
+	if got := sm.PeerState(c); got != StateOkay {
+		t.Fatalf("PeerState() = %v, want OKAY", got)
+	}
+	sm.stopWatchdog(c)
+}
+
+func TestCheckOriginStateIDChanged(t *testing.T) {
+	sm := New(watchdogTestSettings())
+	w := &watchdog{sm: sm, c: newFakeConn(), state: StateOkay}
+
+	newDWA := func(sid uint32) *diam.Message {
+		m := diam.NewRequest(diam.DeviceWatchdog, 0, nil)
+		m.NewAVP(avp.OriginStateID, avp.Mbit, 0, datatype.Unsigned32(sid))
+		return m
+	}
+
+	if changed := w.checkOriginStateID(newDWA(1)); changed {
+		t.Fatal("first Origin-State-Id seen must not be reported as changed")
+	}
+	if changed := w.checkOriginStateID(newDWA(1)); changed {
+		t.Fatal("same Origin-State-Id must not be reported as changed")
+	}
+	if changed := w.checkOriginStateID(newDWA(2)); !changed {
+		t.Fatal("a new Origin-State-Id must be reported as changed")
+	}
+
+	noSID := diam.NewRequest(diam.DeviceWatchdog, 0, nil)
+	if changed := w.checkOriginStateID(noSID); changed {
+		t.Fatal("a DWA with no Origin-State-Id must not be reported as changed")
+	}
+}
+
+// TestHandleDWAReportsOriginStateIDChange exercises the handler used
+// for every inbound DWA: it must surface a changed Origin-State-Id as
+// an ErrorReport so the application can fail over pending requests.
+// The watchdog is registered directly rather than via startWatchdog so
+// this isn't racing against its own Tw timer.
+func TestHandleDWAReportsOriginStateIDChange(t *testing.T) {
+	sm := New(watchdogTestSettings())
+	c := newFakeConn()
+	sm.mu.Lock()
+	sm.watchdogs[c] = &watchdog{sm: sm, c: c, state: StateOkay}
+	sm.mu.Unlock()
+	defer sm.stopWatchdog(c)
+
+	dwr := func(sid uint32) *diam.Message {
+		m := diam.NewRequest(diam.DeviceWatchdog, 0, nil)
+		m.NewAVP(avp.OriginStateID, avp.Mbit, 0, datatype.Unsigned32(sid))
+		return m
+	}
+
+	handleDWA(sm)(c, dwr(1))
+	select {
+	case err := <-sm.ErrorReports():
+		t.Fatalf("unexpected ErrorReport for the first Origin-State-Id seen: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	handleDWA(sm)(c, dwr(2))
+	select {
+	case err := <-sm.ErrorReports():
+		if err.Conn != c {
+			t.Errorf("ErrorReport.Conn = %v, want %v", err.Conn, c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the Origin-State-Id-changed ErrorReport")
+	}
+}